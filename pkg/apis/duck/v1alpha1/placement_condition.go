@@ -0,0 +1,57 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"knative.dev/pkg/apis"
+)
+
+// PlacementConditionDisrupted is the PlacementCondition.Type recorded
+// whenever the scheduler's autoscaler evicts one of a vpod's placements,
+// mirroring the PodDisrupted condition Kubernetes adds to Pods.
+const PlacementConditionDisrupted apis.ConditionType = "Disrupted"
+
+// PlacementCondition records that a vpod's placement was disrupted, e.g. by
+// a compaction, scale-down, or unschedulable-pod eviction. Unlike the
+// top-level duck Status.Conditions, PlacementConditions are additive: a new
+// entry is appended for every disruption rather than toggled in place, so
+// that consumers can see the history of a vpod's placements being moved
+// around.
+//
+// PlacementCondition is not a field of any duck status type in this
+// package: the statefulset scheduler hands it to vpods that implement
+// DisruptionRecorder (pkg/scheduler/statefulset/disruption.go), and storing
+// it is up to those vpods.
+type PlacementCondition struct {
+	// Type is always PlacementConditionDisrupted today, but is kept as a
+	// field for symmetry with apis.Condition and future disruption types.
+	Type apis.ConditionType `json:"type"`
+
+	// Status is corev1.ConditionTrue for the lifetime of this record.
+	Status corev1.ConditionStatus `json:"status"`
+
+	// Reason is the scheduler.EvictionReason that triggered the disruption.
+	Reason string `json:"reason,omitempty"`
+
+	// Message is a human-readable description of the eviction.
+	Message string `json:"message,omitempty"`
+
+	// LastTransitionTime is when the eviction was recorded.
+	LastTransitionTime apis.VolatileTime `json:"lastTransitionTime,omitempty"`
+}
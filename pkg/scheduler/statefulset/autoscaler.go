@@ -0,0 +1,547 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package statefulset implements a VPod scheduler that assigns placements
+// to the pods of a StatefulSet, along with an autoscaler that adjusts the
+// number of replicas of that StatefulSet to fit the pending vreplicas.
+package statefulset
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	"knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
+
+	corev1 "k8s.io/api/core/v1"
+
+	duckv1alpha1 "knative.dev/eventing/pkg/apis/duck/v1alpha1"
+	"knative.dev/eventing/pkg/scheduler"
+	"knative.dev/eventing/pkg/scheduler/state"
+)
+
+const (
+	// sfsName is the name used by tests, and it is also a handy anchor for
+	// pod names, which are of the form "<sfsName>-<ordinal>".
+	sfsName = "statefulset-name"
+
+	defaultRefreshPeriod = 10 * time.Second
+	defaultPodCapacity   = int32(10)
+)
+
+// scaleDownSkipReason explains why a candidate scale-down was not applied
+// on a given cycle.
+type scaleDownSkipReason string
+
+const (
+	// ReasonCooldownActive means a previous scale-down happened less than
+	// Config.ScaleDownCooldown ago.
+	ReasonCooldownActive scaleDownSkipReason = "cool-down-active"
+	// ReasonStabilizationWindow means the proposed replica count hasn't
+	// been stable for Config.ScaleDownDelay yet.
+	ReasonStabilizationWindow scaleDownSkipReason = "stabilization-window"
+	// ReasonReservedReplicasPinned means reserved vreplicas that haven't
+	// shown up in vpod statuses yet still need the current pods.
+	ReasonReservedReplicasPinned scaleDownSkipReason = "reserved-replicas-pinned"
+	// ReasonMinReplicas means Config.MinReplicas prevents shrinking further.
+	ReasonMinReplicas scaleDownSkipReason = "min-replicas"
+)
+
+const (
+	// maxLeaseName is the maximum length Kubernetes allows for an object
+	// name, and therefore the maximum length of a derived lease name.
+	maxLeaseName = 253
+)
+
+// leaseNameFor derives a stable, per-StatefulSet lease name from its
+// namespace and name, so that multiple autoscalers (e.g. one per
+// StatefulSet-backed channel/broker implementation) can run leader election
+// independently of one another instead of sharing a single ephemeral key.
+//
+// The namespace length is encoded in the result so that two different
+// (namespace, name) pairs can never collide on the hyphen-joined
+// concatenation, e.g. ("knative", "eventing-statefulset-name") and
+// ("knative-eventing", "statefulset-name") would otherwise both produce
+// "autoscaler-ephemeral-knative-eventing-statefulset-name".
+//
+// When the natural name would exceed the Kubernetes object name limit, it is
+// replaced by a SHA-256 hash of the inputs so the result stays a valid,
+// collision-resistant object name.
+func leaseNameFor(namespace, name string) string {
+	candidate := fmt.Sprintf("autoscaler-ephemeral-%d-%s-%s", len(namespace), namespace, name)
+	if len(candidate) <= maxLeaseName {
+		return candidate
+	}
+
+	sum := sha256.Sum256([]byte(candidate))
+	return "autoscaler-ephemeral-" + hex.EncodeToString(sum[:])
+}
+
+// EvictionReason identifies why the autoscaler asked the Evictor to remove
+// a placement, so that downstream consumers (metrics, disruption
+// conditions, events) can tell the difference.
+type EvictionReason string
+
+const (
+	// EvictionReasonCompaction is used when a placement is evicted to pack
+	// a vpod onto fewer pods.
+	EvictionReasonCompaction EvictionReason = "Compaction"
+	// EvictionReasonScaleDown is used when a placement is drained ahead of
+	// the StatefulSet shrinking.
+	EvictionReasonScaleDown EvictionReason = "ScaleDown"
+	// EvictionReasonUnschedulablePod is used when a placement is drained
+	// because the pod it sits on was marked unschedulable/cordoned.
+	EvictionReasonUnschedulablePod EvictionReason = "UnschedulablePod"
+	// EvictionReasonOverCapacity is used instead of EvictionReasonCompaction
+	// when a placement evicted by compaction alone exceeds the pod's
+	// capacity. Over-capacity placements are not evicted for that reason
+	// alone.
+	EvictionReasonOverCapacity EvictionReason = "OverCapacity"
+)
+
+// Evictor allows for vreplicas to be evicted, e.g. because the autoscaler
+// wants to compact placements onto fewer pods, or scale the StatefulSet
+// down.
+type Evictor func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement, reason EvictionReason) error
+
+// GetReserved returns the current set of reserved (i.e. not yet visible in
+// the VPod status) vreplicas per vpod and per pod.
+type GetReserved func() map[types.NamespacedName]map[string]int32
+
+// Config for the autoscaler.
+type Config struct {
+	StatefulSetNamespace string
+	StatefulSetName      string
+
+	VPodLister scheduler.VPodLister
+	Evictor    Evictor
+
+	// RefreshPeriod is the min period the autoscaler tries to compact and
+	// scale down the statefulset.
+	RefreshPeriod time.Duration
+
+	// PodCapacity is the maximum number of vreplicas a pod can host.
+	PodCapacity int32
+
+	// MinReplicas is the lowest number of replicas the autoscaler will ever
+	// scale the StatefulSet down to.
+	MinReplicas int32
+
+	// ScaleDownDelay is how long a lower replica count must be the proposed
+	// value before it is actually applied, to avoid thrashing when vpods
+	// churn.
+	ScaleDownDelay time.Duration
+
+	// ScaleDownCooldown is the minimum time to wait after a scale-down
+	// before another one is allowed.
+	ScaleDownCooldown time.Duration
+
+	// CompactorPlugins is the ordered list of compactor plugins that are
+	// evaluated by mayCompact on every cycle. When empty, only
+	// PackLowestOrdinals is enabled.
+	CompactorPlugins []CompactorPluginConfig
+
+	// Recorder is used to surface a Kubernetes Event on a vpod whenever one
+	// of its placements is evicted. Optional: if nil, no event is emitted.
+	Recorder record.EventRecorder
+
+	// LeaseNamespace is the namespace of the lease used for this
+	// autoscaler's leader election key. Defaults to system.Namespace(),
+	// i.e. the actual namespace eventing itself was installed into.
+	LeaseNamespace string
+
+	// getReserved returns reserved replicas that haven't made it into the
+	// vpod status yet. It defaults to nil, in which case no reservation is
+	// taken into account.
+	getReserved GetReserved
+}
+
+// cycle counts autoscaler ticks across all autoscaler instances in this
+// process, purely to give operators a value to correlate log lines for a
+// single tick of a given StatefulSet's autoscaler.
+var cycle uint64
+
+// WithAutoscalerValues returns a context carrying a logr.Logger annotated
+// with values identifying this autoscale cycle, following the contextual
+// logging pattern used by kube-scheduler (klog.FromContext/WithValues): the
+// returned logger, and every logger derived from the returned context, will
+// include these values without every call site having to repeat them.
+func WithAutoscalerValues(ctx context.Context, cfg *Config) (context.Context, logr.Logger) {
+	logger := logr.FromContextOrDiscard(ctx).WithValues(
+		"sfs", cfg.StatefulSetName,
+		"ns", cfg.StatefulSetNamespace,
+		"cycle", atomic.AddUint64(&cycle, 1),
+	)
+	return logr.NewContext(ctx, logger), logger
+}
+
+// autoscaler tries to keep the number of StatefulSet replicas in sync with
+// the number of vreplicas that need to be scheduled, and periodically
+// compacts placements onto the fewest possible pods.
+type autoscaler struct {
+	cfg           *Config
+	stateAccessor state.StateAccessor
+	scaleCache    scheduler.ScaleCache
+
+	// logger is the base logger captured at construction time, e.g. one
+	// already named/tagged by the caller's reconciler. Every log line the
+	// autoscaler emits is a child of this logger, via WithAutoscalerValues.
+	logger logr.Logger
+
+	// leaseKey is this autoscaler's leader-election key, derived from
+	// cfg.StatefulSetNamespace/cfg.StatefulSetName so that autoscalers for
+	// different StatefulSets don't share a bucket.
+	leaseKey types.NamespacedName
+
+	leaderMu    sync.RWMutex
+	isLeaderFor map[string]bool
+
+	// trigger forces an immediate autoscale/compaction cycle, e.g. right
+	// after a new vpod is scheduled.
+	trigger chan struct{}
+
+	clock clock.Clock
+
+	scaleDownMu       sync.Mutex
+	pendingScaleDown  *pendingScaleDown
+	scaleDownCooldown time.Time
+}
+
+// pendingScaleDown tracks a candidate lower replica count and how long it
+// has been proposed for, so it can be applied once it has been stable for
+// Config.ScaleDownDelay.
+type pendingScaleDown struct {
+	replicas int32
+	since    time.Time
+}
+
+// newAutoscaler creates a new autoscaler, filling in defaults for anything
+// left unset on cfg. The logr.Logger carried by ctx is captured as the base
+// logger for every log line the autoscaler emits later on; see
+// WithAutoscalerValues.
+func newAutoscaler(ctx context.Context, cfg *Config, stateAccessor state.StateAccessor, scaleCache scheduler.ScaleCache) *autoscaler {
+	if cfg.RefreshPeriod <= 0 {
+		cfg.RefreshPeriod = defaultRefreshPeriod
+	}
+	if cfg.PodCapacity <= 0 {
+		cfg.PodCapacity = defaultPodCapacity
+	}
+	if len(cfg.CompactorPlugins) == 0 {
+		cfg.CompactorPlugins = []CompactorPluginConfig{{Name: PackLowestOrdinalsName}}
+	}
+	if cfg.LeaseNamespace == "" {
+		cfg.LeaseNamespace = system.Namespace()
+	}
+
+	return &autoscaler{
+		cfg:           cfg,
+		stateAccessor: stateAccessor,
+		scaleCache:    scaleCache,
+		logger:        logr.FromContextOrDiscard(ctx),
+		leaseKey: types.NamespacedName{
+			Namespace: cfg.LeaseNamespace,
+			Name:      leaseNameFor(cfg.StatefulSetNamespace, cfg.StatefulSetName),
+		},
+		isLeaderFor: make(map[string]bool, 1),
+		trigger:     make(chan struct{}, 1),
+		clock:       clock.RealClock{},
+	}
+}
+
+// setLeader records whether this autoscaler is the leader for its leaseKey.
+func (a *autoscaler) setLeader(leading bool) {
+	a.leaderMu.Lock()
+	defer a.leaderMu.Unlock()
+	a.isLeaderFor[a.leaseKey.Name] = leading
+}
+
+// leading reports whether this autoscaler currently believes it is the
+// leader for its leaseKey.
+func (a *autoscaler) leading() bool {
+	a.leaderMu.RLock()
+	defer a.leaderMu.RUnlock()
+	return a.isLeaderFor[a.leaseKey.Name]
+}
+
+// Promote implements reconciler.LeaderAware.
+func (a *autoscaler) Promote(b reconciler.Bucket, _ func(reconciler.Bucket, types.NamespacedName)) error {
+	if b.Has(a.leaseKey) {
+		a.setLeader(true)
+	}
+	return nil
+}
+
+// Demote implements reconciler.LeaderAware.
+func (a *autoscaler) Demote(b reconciler.Bucket) {
+	if b.Has(a.leaseKey) {
+		a.setLeader(false)
+	}
+}
+
+// Start runs the autoscale/compaction loop until ctx is done.
+func (a *autoscaler) Start(ctx context.Context) {
+	ctx = logr.NewContext(ctx, a.logger)
+
+	ticker := time.NewTicker(a.cfg.RefreshPeriod)
+	defer ticker.Stop()
+
+	attemptScaleDown := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-a.trigger:
+			attemptScaleDown = false
+		case <-ticker.C:
+			attemptScaleDown = true
+		}
+
+		if !a.leading() {
+			continue
+		}
+
+		cycleCtx, logger := WithAutoscalerValues(ctx, a.cfg)
+
+		// stateAccessor.State already takes cycleCtx, so the per-cycle
+		// logger reaches the state builder the same contextual way it
+		// reaches mayCompact/syncAutoscale below, with no signature change
+		// needed on the state.StateAccessor side.
+		if s, err := a.stateAccessor.State(cycleCtx); err != nil {
+			logger.Error(err, "failed to build scheduler state")
+		} else if err := a.mayCompact(cycleCtx, s); err != nil {
+			logger.Error(err, "failed to compact")
+		}
+
+		if err := a.syncAutoscale(cycleCtx, attemptScaleDown); err != nil {
+			logger.Error(err, "failed to sync autoscaler")
+		}
+	}
+}
+
+// syncAutoscale reconciles the StatefulSet's replica count with the number
+// of vreplicas that are currently pending scheduling. Replicas are only
+// ever shrunk when scaleDown is true.
+//
+// ctx is expected to already carry the per-cycle logger set up by the
+// caller via WithAutoscalerValues, so that its log lines share the same
+// "cycle" value as the mayCompact call for the same tick.
+func (a *autoscaler) syncAutoscale(ctx context.Context, scaleDown bool) error {
+	logger := logr.FromContextOrDiscard(ctx)
+
+	vpods, err := a.cfg.VPodLister()
+	if err != nil {
+		return fmt.Errorf("failed to list vpods: %w", err)
+	}
+
+	var totalVReplicas int32
+	for _, vpod := range vpods {
+		vReplicas := vpod.GetVReplicas()
+		totalVReplicas += vReplicas
+		logger.V(4).Info("pending vreplicas", "vpod", vpod.GetKey(), "vreplicas", vReplicas)
+	}
+
+	var reserved map[types.NamespacedName]map[string]int32
+	if a.cfg.getReserved != nil {
+		reserved = a.cfg.getReserved()
+	}
+	var reservedVReplicas int32
+	for vpod, byPod := range reserved {
+		for pod, v := range byPod {
+			reservedVReplicas += v
+			logger.V(4).Info("reserved vreplicas", "vpod", vpod, "pod", pod, "vreplicas", v)
+		}
+	}
+
+	sfsClient := kubeclient.Get(ctx).AppsV1().StatefulSets(a.cfg.StatefulSetNamespace)
+	scale, err := sfsClient.GetScale(ctx, a.cfg.StatefulSetName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get scale subresource for %s/%s: %w", a.cfg.StatefulSetNamespace, a.cfg.StatefulSetName, err)
+	}
+
+	currentReplicas := scale.Spec.Replicas
+	neededReplicas := int32(math.Ceil(float64(totalVReplicas) / float64(a.cfg.PodCapacity)))
+
+	logger.V(4).Info("computed replica counts", "currentReplicas", currentReplicas, "neededReplicas", neededReplicas, "totalVReplicas", totalVReplicas, "reservedVReplicas", reservedVReplicas)
+
+	desiredReplicas := currentReplicas
+	switch {
+	case neededReplicas > currentReplicas:
+		desiredReplicas = neededReplicas
+		a.resetScaleDownTracking()
+
+	case neededReplicas < currentReplicas:
+		if !scaleDown {
+			a.resetScaleDownTracking()
+			break
+		}
+
+		if currentReplicas == a.cfg.MinReplicas {
+			// Already at the floor: there is nothing to apply, so no
+			// scale-down is left pending.
+			a.resetScaleDownTracking()
+			logger.Info("skipping scale-down",
+				"reason", ReasonMinReplicas,
+				"currentReplicas", currentReplicas,
+				"proposedReplicas", currentReplicas,
+				"pendingVReplicas", totalVReplicas,
+				"reservedVReplicas", reservedVReplicas)
+			break
+		}
+
+		proposed, reason, ok := a.evaluateScaleDown(neededReplicas, reservedVReplicas)
+		if !ok {
+			logger.Info("skipping scale-down",
+				"reason", reason,
+				"currentReplicas", currentReplicas,
+				"proposedReplicas", proposed,
+				"pendingVReplicas", totalVReplicas,
+				"reservedVReplicas", reservedVReplicas)
+			break
+		}
+		desiredReplicas = proposed
+
+	default:
+		a.resetScaleDownTracking()
+	}
+
+	if desiredReplicas == currentReplicas {
+		return nil
+	}
+
+	logger.Info("updating statefulset replicas", "from", currentReplicas, "to", desiredReplicas)
+
+	if desiredReplicas < currentReplicas {
+		if err := a.drainAbove(ctx, logger, vpods, desiredReplicas); err != nil {
+			return fmt.Errorf("failed to drain placements ahead of scale-down: %w", err)
+		}
+	}
+
+	scale.Spec.Replicas = desiredReplicas
+	_, err = sfsClient.UpdateScale(ctx, a.cfg.StatefulSetName, scale, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	if desiredReplicas < currentReplicas {
+		a.scaleDownMu.Lock()
+		a.scaleDownCooldown = a.clock.Now().Add(a.cfg.ScaleDownCooldown)
+		a.pendingScaleDown = nil
+		a.scaleDownMu.Unlock()
+		pendingScaleDownGauge.WithLabelValues(a.cfg.StatefulSetNamespace, a.cfg.StatefulSetName).Set(0)
+	}
+
+	return nil
+}
+
+// evaluateScaleDown decides whether the proposed (lower) replica count can
+// be applied yet, honoring MinReplicas, reserved vreplicas, the
+// stabilization window and the cooldown that follows a scale-down.
+func (a *autoscaler) evaluateScaleDown(proposed, reservedVReplicas int32) (int32, scaleDownSkipReason, bool) {
+	a.scaleDownMu.Lock()
+	defer a.scaleDownMu.Unlock()
+
+	now := a.clock.Now()
+
+	if now.Before(a.scaleDownCooldown) {
+		return proposed, ReasonCooldownActive, false
+	}
+
+	if floor := int32(math.Ceil(float64(reservedVReplicas) / float64(a.cfg.PodCapacity))); proposed < floor {
+		return floor, ReasonReservedReplicasPinned, false
+	}
+
+	clampedToMinReplicas := false
+	if proposed < a.cfg.MinReplicas {
+		proposed = a.cfg.MinReplicas
+		clampedToMinReplicas = true
+	}
+
+	if a.pendingScaleDown == nil || a.pendingScaleDown.replicas != proposed {
+		a.pendingScaleDown = &pendingScaleDown{replicas: proposed, since: now}
+		pendingScaleDownGauge.WithLabelValues(a.cfg.StatefulSetNamespace, a.cfg.StatefulSetName).Set(float64(now.Add(a.cfg.ScaleDownDelay).Unix()))
+
+		if clampedToMinReplicas {
+			// Informational only: report that we clamped to the floor on
+			// the cycle it was first observed, but still let the
+			// stabilization window below run its course so the
+			// StatefulSet actually settles at MinReplicas once stable,
+			// instead of refusing to move forever.
+			return proposed, ReasonMinReplicas, false
+		}
+	}
+
+	if now.Sub(a.pendingScaleDown.since) < a.cfg.ScaleDownDelay {
+		return proposed, ReasonStabilizationWindow, false
+	}
+
+	return proposed, "", true
+}
+
+// drainAbove evicts every placement sitting on a pod whose ordinal is at or
+// above newReplicas, ahead of the StatefulSet actually shrinking to that
+// size.
+func (a *autoscaler) drainAbove(ctx context.Context, logger logr.Logger, vpods []scheduler.VPod, newReplicas int32) error {
+	podsClient := kubeclient.Get(ctx).CoreV1().Pods(a.cfg.StatefulSetNamespace)
+
+	for _, vpod := range vpods {
+		for _, placement := range vpod.GetPlacements() {
+			placement := placement
+
+			ordinal, err := ordinalFromPodName(placement.PodName)
+			if err != nil || ordinal < newReplicas {
+				continue
+			}
+
+			pod, err := podsClient.Get(ctx, placement.PodName, metav1.GetOptions{})
+			if err != nil {
+				logger.Error(err, "failed to get pod ahead of scale-down drain, skipping", "pod", placement.PodName)
+				continue
+			}
+
+			if err := a.evict(logger, pod, vpod, &placement, EvictionReasonScaleDown); err != nil {
+				return fmt.Errorf("failed to evict vpod %v from %s: %w", vpod.GetKey(), placement.PodName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// resetScaleDownTracking clears any pending scale-down candidate, e.g.
+// because vpod demand grew back above it.
+func (a *autoscaler) resetScaleDownTracking() {
+	a.scaleDownMu.Lock()
+	defer a.scaleDownMu.Unlock()
+
+	if a.pendingScaleDown == nil {
+		return
+	}
+	a.pendingScaleDown = nil
+	pendingScaleDownGauge.WithLabelValues(a.cfg.StatefulSetNamespace, a.cfg.StatefulSetName).Set(0)
+}
@@ -0,0 +1,289 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clocktesting "k8s.io/utils/clock/testing"
+
+	duckv1alpha1 "knative.dev/eventing/pkg/apis/duck/v1alpha1"
+	"knative.dev/eventing/pkg/scheduler"
+	"knative.dev/eventing/pkg/scheduler/state"
+	tscheduler "knative.dev/eventing/pkg/scheduler/testing"
+
+	corev1 "k8s.io/api/core/v1"
+	kubeclient "knative.dev/pkg/client/injection/kube/client/fake"
+	_ "knative.dev/pkg/client/injection/kube/informers/apps/v1/statefulset/fake"
+	"knative.dev/pkg/reconciler"
+)
+
+// scaleDownStep is one step of TestScaleDownStabilization: the test advances
+// the fake clock by advance (if non-zero), runs a
+// syncAutoscale(scaleDown=true) cycle and asserts wantReplicas.
+type scaleDownStep struct {
+	name         string
+	advance      time.Duration
+	wantReplicas int32
+}
+
+func TestScaleDownStabilization(t *testing.T) {
+	const (
+		scaleDownDelay    = 30 * time.Second
+		scaleDownCooldown = 60 * time.Second
+	)
+
+	ctx, _ := tscheduler.SetupFakeContext(t)
+
+	vpodClient := tscheduler.NewVPodClient()
+	placements := []duckv1alpha1.Placement{
+		{PodName: sfsName + "-0", VReplicas: int32(10)},
+		{PodName: sfsName + "-1", VReplicas: int32(10)},
+		{PodName: sfsName + "-2", VReplicas: int32(10)},
+	}
+	vpodClient.Append(tscheduler.NewVPod(testNs, "vpod-1", 30, placements))
+
+	for i := int32(0); i < 3; i++ {
+		podName := fmt.Sprintf("%s-%d", sfsName, i)
+		if _, err := kubeclient.Get(ctx).CoreV1().Pods(testNs).Create(ctx, tscheduler.MakePod(testNs, podName, fmt.Sprintf("node%d", i)), metav1.CreateOptions{}); err != nil {
+			t.Fatal("unexpected error", err)
+		}
+	}
+
+	scaleCache := scheduler.NewScaleCache(ctx, testNs, kubeclient.Get(ctx).AppsV1().StatefulSets(testNs), scheduler.ScaleCacheConfig{RefreshPeriod: time.Minute * 5})
+	stateAccessor := state.NewStateBuilder(sfsName, vpodClient.List, 10, nil, scaleCache)
+
+	sfsClient := kubeclient.Get(ctx).AppsV1().StatefulSets(testNs)
+	if _, err := sfsClient.Create(ctx, tscheduler.MakeStatefulset(testNs, sfsName, 3), metav1.CreateOptions{}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	var evictedPods []string
+	var evictedReasons []EvictionReason
+	recordEvictor := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement, reason EvictionReason) error {
+		evictedPods = append(evictedPods, from.PodName)
+		evictedReasons = append(evictedReasons, reason)
+		return nil
+	}
+
+	cfg := &Config{
+		StatefulSetNamespace: testNs,
+		StatefulSetName:      sfsName,
+		VPodLister:           vpodClient.List,
+		Evictor:              recordEvictor,
+		RefreshPeriod:        10 * time.Second,
+		PodCapacity:          10,
+		ScaleDownDelay:       scaleDownDelay,
+		ScaleDownCooldown:    scaleDownCooldown,
+		getReserved: func() map[types.NamespacedName]map[string]int32 {
+			return nil
+		},
+	}
+	autoscaler := newAutoscaler(ctx, cfg, stateAccessor, scaleCache)
+	fakeClock := clocktesting.NewFakeClock(time.Now())
+	autoscaler.clock = fakeClock
+	_ = autoscaler.Promote(reconciler.UniversalBucket(), nil)
+
+	// Shrink the vpod's demand from 30 to 5 vreplicas: with a capacity of 10
+	// per pod that means a single replica is now enough.
+	vpodClient.Append(tscheduler.NewVPod(testNs, "vpod-1", 5, placements))
+
+	steps := []scaleDownStep{
+		{name: "first observation, within stabilization window", advance: 0, wantReplicas: 3},
+		{name: "still within stabilization window", advance: scaleDownDelay / 2, wantReplicas: 3},
+		{name: "stabilization window elapsed, scales down", advance: scaleDownDelay, wantReplicas: 1},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			fakeClock.Step(step.advance)
+
+			if err := autoscaler.syncAutoscale(ctx, true); err != nil {
+				t.Fatal("unexpected error", err)
+			}
+
+			scale, err := sfsClient.GetScale(ctx, sfsName, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal("unexpected error", err)
+			}
+			if scale.Spec.Replicas != step.wantReplicas {
+				t.Errorf("unexpected number of replicas, got %d, want %d", scale.Spec.Replicas, step.wantReplicas)
+			}
+		})
+	}
+
+	// The last step above actually applied the scale-down from 3 to 1
+	// replicas: drainAbove must have evicted the placements sitting on the
+	// two pods that are going away, and only those, tagged with
+	// EvictionReasonScaleDown.
+	assert.ElementsMatch(t, []string{sfsName + "-1", sfsName + "-2"}, evictedPods)
+	for _, reason := range evictedReasons {
+		assert.Equal(t, EvictionReasonScaleDown, reason)
+	}
+
+	// Demand drops further to zero, but the cooldown from the scale-down
+	// above should still be in effect.
+	vpodClient.Append(tscheduler.NewVPod(testNs, "vpod-1", 0, nil))
+	if err := autoscaler.syncAutoscale(ctx, true); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	scale, err := sfsClient.GetScale(ctx, sfsName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if scale.Spec.Replicas != 1 {
+		t.Errorf("expected scale-down to be blocked by cool-down, got %d replicas", scale.Spec.Replicas)
+	}
+
+	// Once the cooldown elapses, and the lower value has been stable for
+	// the stabilization window, it is applied.
+	fakeClock.Step(scaleDownCooldown)
+	if err := autoscaler.syncAutoscale(ctx, true); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	fakeClock.Step(scaleDownDelay)
+	if err := autoscaler.syncAutoscale(ctx, true); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	scale, err = sfsClient.GetScale(ctx, sfsName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal("unexpected error", err)
+	}
+	if scale.Spec.Replicas != 0 {
+		t.Errorf("expected statefulset to scale to 0 after cool-down, got %d replicas", scale.Spec.Replicas)
+	}
+}
+
+// TestEvaluateScaleDown table-tests evaluateScaleDown directly, covering
+// every scaleDownSkipReason, including MinReplicas clamping and reserved
+// vreplicas pinning, which TestScaleDownStabilization above doesn't reach.
+func TestEvaluateScaleDown(t *testing.T) {
+	const (
+		podCapacity       = int32(10)
+		scaleDownDelay    = 30 * time.Second
+		scaleDownCooldown = 60 * time.Second
+	)
+
+	testCases := []struct {
+		name              string
+		minReplicas       int32
+		proposed          int32
+		reservedVReplicas int32
+		cooldownActive    bool
+		wantReplicas      int32
+		wantReason        scaleDownSkipReason
+		wantOK            bool
+		// blocksPermanently marks cases that don't converge when the
+		// stabilization window elapses, because the skip reason doesn't
+		// depend on the stabilization window at all (cooldown, reserved
+		// replicas pinning the floor); only the first call is checked.
+		blocksPermanently bool
+	}{
+		{
+			name:              "cooldown active blocks the scale-down",
+			proposed:          int32(1),
+			cooldownActive:    true,
+			wantReplicas:      int32(1),
+			wantReason:        ReasonCooldownActive,
+			wantOK:            false,
+			blocksPermanently: true,
+		},
+		{
+			name:              "reserved vreplicas pin the floor above the proposed value",
+			proposed:          int32(1),
+			reservedVReplicas: int32(25),
+			wantReplicas:      int32(3),
+			wantReason:        ReasonReservedReplicasPinned,
+			wantOK:            false,
+			blocksPermanently: true,
+		},
+		{
+			name:         "min replicas clamps the proposed value, but still converges once stable",
+			minReplicas:  int32(2),
+			proposed:     int32(1),
+			wantReplicas: int32(2),
+			wantReason:   ReasonMinReplicas,
+			wantOK:       true,
+		},
+		{
+			name:         "proposed value at min replicas is allowed once stable",
+			minReplicas:  int32(2),
+			proposed:     int32(2),
+			wantReplicas: int32(2),
+			wantOK:       true,
+		},
+		{
+			name:         "no skip reason, proposed value is applied once stable",
+			proposed:     int32(1),
+			wantReplicas: int32(1),
+			wantOK:       true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeClock := clocktesting.NewFakeClock(time.Now())
+
+			a := &autoscaler{
+				cfg: &Config{
+					StatefulSetNamespace: testNs,
+					StatefulSetName:      sfsName,
+					PodCapacity:          podCapacity,
+					MinReplicas:          tc.minReplicas,
+					ScaleDownDelay:       scaleDownDelay,
+					ScaleDownCooldown:    scaleDownCooldown,
+				},
+				clock: fakeClock,
+			}
+			if tc.cooldownActive {
+				a.scaleDownCooldown = fakeClock.Now().Add(scaleDownCooldown)
+			}
+
+			// First call only starts the stabilization window; it must
+			// never immediately succeed unless a skip reason fires first.
+			replicas, reason, ok := a.evaluateScaleDown(tc.proposed, tc.reservedVReplicas)
+			if tc.blocksPermanently {
+				assert.Equal(t, tc.wantReplicas, replicas)
+				assert.Equal(t, tc.wantReason, reason)
+				assert.False(t, ok)
+				return
+			}
+			assert.Equal(t, tc.wantReplicas, replicas)
+			if tc.wantReason != "" {
+				assert.Equal(t, tc.wantReason, reason)
+			} else {
+				assert.Equal(t, ReasonStabilizationWindow, reason)
+			}
+			assert.False(t, ok)
+
+			// Once the stabilization window elapses, the proposed value is
+			// applied, even if it was clamped to MinReplicas along the way.
+			fakeClock.Step(scaleDownDelay)
+			replicas, reason, ok = a.evaluateScaleDown(tc.proposed, tc.reservedVReplicas)
+			assert.Equal(t, tc.wantReplicas, replicas)
+			assert.Equal(t, tc.wantOK, ok)
+			if !tc.wantOK {
+				assert.Equal(t, tc.wantReason, reason)
+			}
+		})
+	}
+}
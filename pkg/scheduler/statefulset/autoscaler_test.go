@@ -19,7 +19,9 @@ package statefulset
 import (
 	"fmt"
 	"math"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -30,8 +32,11 @@ import (
 	"k8s.io/apimachinery/pkg/types"
 	v1 "k8s.io/client-go/listers/core/v1"
 	gtesting "k8s.io/client-go/testing"
-	"knative.dev/pkg/logging"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
 	"knative.dev/pkg/reconciler"
+	"knative.dev/pkg/system"
 
 	kubeclient "knative.dev/pkg/client/injection/kube/client/fake"
 	_ "knative.dev/pkg/client/injection/kube/informers/apps/v1/statefulset/fake"
@@ -48,6 +53,15 @@ const (
 	testNs = "test-ns"
 )
 
+// TestMain sets the system namespace env var read by system.Namespace(),
+// which newAutoscaler falls back on for Config.LeaseNamespace: without it,
+// every test in this package that doesn't set LeaseNamespace explicitly
+// would panic constructing an autoscaler.
+func TestMain(m *testing.M) {
+	os.Setenv(system.NamespaceEnvKey, "knative-testing")
+	os.Exit(m.Run())
+}
+
 func TestAutoscaler(t *testing.T) {
 	testCases := []struct {
 		name         string
@@ -319,7 +333,7 @@ func TestAutoscaler(t *testing.T) {
 				t.Fatal("unexpected error", err)
 			}
 
-			noopEvictor := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement) error {
+			noopEvictor := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement, reason EvictionReason) error {
 				return nil
 			}
 
@@ -334,7 +348,7 @@ func TestAutoscaler(t *testing.T) {
 					return tc.reserved
 				},
 			}
-			autoscaler := newAutoscaler(cfg, stateAccessor, scaleCache)
+			autoscaler := newAutoscaler(ctx, cfg, stateAccessor, scaleCache)
 			_ = autoscaler.Promote(reconciler.UniversalBucket(), nil)
 
 			for _, vpod := range tc.vpods {
@@ -379,7 +393,7 @@ func TestAutoscalerScaleDownToZero(t *testing.T) {
 		t.Fatal("unexpected error", err)
 	}
 
-	noopEvictor := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement) error {
+	noopEvictor := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement, reason EvictionReason) error {
 		return nil
 	}
 
@@ -394,7 +408,7 @@ func TestAutoscalerScaleDownToZero(t *testing.T) {
 			return nil
 		},
 	}
-	autoscaler := newAutoscaler(cfg, stateAccessor, scaleCache)
+	autoscaler := newAutoscaler(ctx, cfg, stateAccessor, scaleCache)
 	_ = autoscaler.Promote(reconciler.UniversalBucket(), nil)
 
 	done := make(chan bool)
@@ -504,6 +518,26 @@ func TestCompactor(t *testing.T) {
 				{Name: "vpod-2", Namespace: testNs}: {{PodName: "statefulset-name-2", VReplicas: int32(7)}},
 			},
 		},
+		{
+			name:     "several single-placement vpods, compacted onto fewer pods",
+			replicas: int32(3),
+			// pod-0:3, pod-1:3, pod-2:3, total 9 needs only 1 pod at
+			// capacity 10: every vpod has just one placement, but two of
+			// them sit above the cluster-wide minimum and must still be
+			// evicted.
+			vpods: []scheduler.VPod{
+				tscheduler.NewVPod(testNs, "vpod-1", 3, []duckv1alpha1.Placement{
+					{PodName: "statefulset-name-0", VReplicas: int32(3)}}),
+				tscheduler.NewVPod(testNs, "vpod-2", 3, []duckv1alpha1.Placement{
+					{PodName: "statefulset-name-1", VReplicas: int32(3)}}),
+				tscheduler.NewVPod(testNs, "vpod-3", 3, []duckv1alpha1.Placement{
+					{PodName: "statefulset-name-2", VReplicas: int32(3)}}),
+			},
+			wantEvictions: map[types.NamespacedName][]duckv1alpha1.Placement{
+				{Name: "vpod-2", Namespace: testNs}: {{PodName: "statefulset-name-1", VReplicas: int32(3)}},
+				{Name: "vpod-3", Namespace: testNs}: {{PodName: "statefulset-name-2", VReplicas: int32(3)}},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -533,8 +567,10 @@ func TestCompactor(t *testing.T) {
 			stateAccessor := state.NewStateBuilder(sfsName, vpodClient.List, 10, lsp.GetPodLister().Pods(testNs), scaleCache)
 
 			evictions := make(map[types.NamespacedName][]duckv1alpha1.Placement)
-			recordEviction := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement) error {
+			reasons := make(map[types.NamespacedName][]EvictionReason)
+			recordEviction := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement, reason EvictionReason) error {
 				evictions[vpod.GetKey()] = append(evictions[vpod.GetKey()], *from)
+				reasons[vpod.GetKey()] = append(reasons[vpod.GetKey()], reason)
 				return nil
 			}
 
@@ -546,9 +582,9 @@ func TestCompactor(t *testing.T) {
 				RefreshPeriod:        10 * time.Second,
 				PodCapacity:          10,
 			}
-			autoscaler := newAutoscaler(cfg, stateAccessor, scaleCache)
+			autoscaler := newAutoscaler(ctx, cfg, stateAccessor, scaleCache)
 			_ = autoscaler.Promote(reconciler.UniversalBucket(), func(bucket reconciler.Bucket, name types.NamespacedName) {})
-			assert.Equal(t, true, autoscaler.isLeader.Load())
+			assert.Equal(t, true, autoscaler.leading())
 
 			for _, vpod := range tc.vpods {
 				vpodClient.Append(vpod)
@@ -559,7 +595,7 @@ func TestCompactor(t *testing.T) {
 				t.Fatalf("unexpected error: %v", err)
 			}
 
-			if err := autoscaler.mayCompact(logging.FromContext(ctx), state); err != nil {
+			if err := autoscaler.mayCompact(logr.NewContext(ctx, testr.New(t)), state); err != nil {
 				t.Fatal(err)
 			}
 
@@ -577,6 +613,12 @@ func TestCompactor(t *testing.T) {
 					t.Fatalf("expected evicted placement to be %v, but got %v", placements, got)
 				}
 
+				for _, reason := range reasons[key] {
+					if reason != EvictionReasonCompaction {
+						t.Errorf("expected eviction reason %q, got %q", EvictionReasonCompaction, reason)
+					}
+				}
+
 				delete(evictions, key)
 			}
 
@@ -585,13 +627,49 @@ func TestCompactor(t *testing.T) {
 			}
 
 			autoscaler.Demote(reconciler.UniversalBucket())
-			assert.Equal(t, false, autoscaler.isLeader.Load())
+			assert.Equal(t, false, autoscaler.leading())
 		})
 	}
 }
 
 func TestEphemeralKeyStableValues(t *testing.T) {
-	// Do not modify expected values
-	assert.Equal(t, "knative-eventing", ephemeralLeaderElectionObject.Namespace)
-	assert.Equal(t, "autoscaler-ephemeral", ephemeralLeaderElectionObject.Name)
+	// Do not modify expected values: these pin the exact lease names
+	// produced for a handful of namespace/name pairs, including one long
+	// enough to be hashed, so that a future refactor can't silently change
+	// which lease existing deployments are leader-electing on.
+	assert.Equal(t, "autoscaler-ephemeral-16-knative-eventing-statefulset-name", leaseNameFor("knative-eventing", "statefulset-name"))
+	assert.Equal(t, "autoscaler-ephemeral-4-ns-a-name-a", leaseNameFor("ns-a", "name-a"))
+	assert.Equal(t, "autoscaler-ephemeral-4-ns-b-name-a", leaseNameFor("ns-b", "name-a"))
+
+	longName := strings.Repeat("a", 300)
+	got := leaseNameFor("knative-eventing", longName)
+	assert.LessOrEqual(t, len(got), maxLeaseName)
+	assert.True(t, strings.HasPrefix(got, "autoscaler-ephemeral-"))
+
+	// Different long names must not collide.
+	assert.NotEqual(t, got, leaseNameFor("knative-eventing", strings.Repeat("b", 300)))
+
+	// Deriving twice from the same inputs must be stable.
+	assert.Equal(t, got, leaseNameFor("knative-eventing", longName))
+}
+
+func TestLeaseNamespaceDefaultsToSystemNamespace(t *testing.T) {
+	ctx, _ := tscheduler.SetupFakeContext(t)
+
+	cfg := &Config{
+		StatefulSetNamespace: testNs,
+		StatefulSetName:      sfsName,
+		VPodLister:           tscheduler.NewVPodClient().List,
+	}
+	a := newAutoscaler(ctx, cfg, nil, nil)
+
+	assert.Equal(t, system.Namespace(), cfg.LeaseNamespace)
+	assert.Equal(t, system.Namespace(), a.leaseKey.Namespace)
+}
+
+func TestEphemeralKeyAmbiguousBoundary(t *testing.T) {
+	// Without a length-prefix (or similar), "a" + "b-c" and "a-b" + "c"
+	// hyphen-join to the identical candidate string. Two unrelated
+	// StatefulSets must not end up sharing a lease key because of this.
+	assert.NotEqual(t, leaseNameFor("a", "b-c"), leaseNameFor("a-b", "c"))
 }
@@ -0,0 +1,325 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+
+	duckv1alpha1 "knative.dev/eventing/pkg/apis/duck/v1alpha1"
+	"knative.dev/eventing/pkg/scheduler"
+	"knative.dev/eventing/pkg/scheduler/state"
+)
+
+// Names of the built-in compactor plugins.
+const (
+	PackLowestOrdinalsName         = "PackLowestOrdinals"
+	RemoveDuplicatePlacementsName  = "RemoveDuplicatePlacements"
+	EvictFromUnschedulablePodsName = "EvictFromUnschedulablePods"
+
+	// unschedulablePodAnnotation lets an operator force a pod to be treated
+	// as unschedulable even if its node isn't cordoned yet, e.g. ahead of a
+	// planned drain. It is not required for the normal cordoned-node case,
+	// which is detected via the pod's node's Spec.Unschedulable.
+	unschedulablePodAnnotation = "eventing.knative.dev/unschedulable"
+)
+
+// Eviction is a single placement that a CompactorPlugin wants removed from
+// a vpod.
+type Eviction struct {
+	VPod   scheduler.VPod
+	From   *duckv1alpha1.Placement
+	Reason EvictionReason
+}
+
+// CompactorPluginConfig selects a registered CompactorPlugin by name.
+type CompactorPluginConfig struct {
+	Name string
+}
+
+// CompactorPlugin is modeled after sigs.k8s.io/descheduler's plugin
+// framework: Filter narrows down the vpods a plugin cares about, and
+// Evictions computes the placements that should be evicted from those
+// vpods.
+type CompactorPlugin interface {
+	// Name uniquely identifies the plugin, and is what CompactorPluginConfig.Name
+	// refers to.
+	Name() string
+
+	// Filter returns the subset of the vpods in s that this plugin applies to.
+	Filter(s *state.State) []scheduler.VPod
+
+	// Evictions computes the placements that should be evicted from vpods.
+	Evictions(ctx context.Context, s *state.State, vpods []scheduler.VPod) ([]Eviction, error)
+}
+
+var compactorPluginRegistry = map[string]CompactorPlugin{}
+
+// RegisterCompactorPlugin makes a CompactorPlugin available by name to
+// Config.CompactorPlugins.
+func RegisterCompactorPlugin(p CompactorPlugin) {
+	compactorPluginRegistry[p.Name()] = p
+}
+
+func init() {
+	RegisterCompactorPlugin(&packLowestOrdinals{})
+	RegisterCompactorPlugin(&removeDuplicatePlacements{})
+	RegisterCompactorPlugin(&evictFromUnschedulablePods{})
+}
+
+// mayCompact runs the configured compactor plugins, in order, and hands
+// every resulting Eviction to the configured Evictor.
+//
+// ctx is expected to already carry the per-cycle logger set up by the
+// caller via WithAutoscalerValues, and is passed down to every plugin's
+// Evictions call so cancellation/deadlines from the real request context
+// reach plugin code instead of a bare context.Background().
+func (a *autoscaler) mayCompact(ctx context.Context, s *state.State) error {
+	if s == nil {
+		return nil
+	}
+
+	logger := logr.FromContextOrDiscard(ctx)
+
+	for _, pc := range a.cfg.CompactorPlugins {
+		plugin, ok := compactorPluginRegistry[pc.Name]
+		if !ok {
+			logger.Info("unknown compactor plugin configured, skipping", "plugin", pc.Name)
+			continue
+		}
+
+		vpods := plugin.Filter(s)
+		logger.V(4).Info("compactor plugin filtered vpods", "plugin", plugin.Name(), "vpods", len(vpods))
+		if len(vpods) == 0 {
+			continue
+		}
+
+		evictions, err := plugin.Evictions(ctx, s, vpods)
+		if err != nil {
+			return fmt.Errorf("compactor plugin %q failed: %w", plugin.Name(), err)
+		}
+
+		for _, ev := range evictions {
+			pod, err := a.podFor(s, ev.From.PodName)
+			if err != nil {
+				logger.Error(err, "failed to get pod for eviction, skipping", "pod", ev.From.PodName)
+				continue
+			}
+
+			logger.V(4).Info("evicting vpod placement", "plugin", plugin.Name(), "vpod", ev.VPod.GetKey(), "pod", ev.From.PodName, "reason", ev.Reason)
+			if err := a.evict(logger, pod, ev.VPod, ev.From, ev.Reason); err != nil {
+				return fmt.Errorf("failed to evict vpod %v from %s: %w", ev.VPod.GetKey(), ev.From.PodName, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (a *autoscaler) podFor(s *state.State, podName string) (*corev1.Pod, error) {
+	if s.PodLister == nil {
+		return nil, fmt.Errorf("no pod lister available")
+	}
+	return s.PodLister.Get(podName)
+}
+
+// packLowestOrdinals is the default compactor plugin: it packs placements
+// onto the lowest-ordinal pods the whole StatefulSet needs, evicting
+// placements from any pod above that.
+type packLowestOrdinals struct{}
+
+func (p *packLowestOrdinals) Name() string { return PackLowestOrdinalsName }
+
+// Filter returns every vpod with at least one placement. Evictions below
+// decides per-placement, by pod ordinal, against the cluster-wide minimum
+// pod count, so even a vpod with a single placement must be considered: the
+// cluster-wide minimum can exclude its one (high-ordinal) pod just as
+// easily as it can exclude one of several placements belonging to a vpod
+// with more than one.
+func (p *packLowestOrdinals) Filter(s *state.State) []scheduler.VPod {
+	var out []scheduler.VPod
+	for _, vpod := range s.VPods {
+		if len(vpod.GetPlacements()) > 0 {
+			out = append(out, vpod)
+		}
+	}
+	return out
+}
+
+// Evictions packs placements onto the lowest-ordinal pods that the whole
+// StatefulSet needs, not just the pods a single vpod happens to occupy: it
+// first sums up every vpod's occupancy (not only the ones passed in vpods)
+// to get the cluster-wide minimum number of pods required, then evicts any
+// placement sitting above that. Reasoning about a single vpod's own
+// total/capacity in isolation ignores how much of its lowest-ordinal pods
+// are already claimed by other vpods, and can propose evictions that have
+// nowhere to land.
+func (p *packLowestOrdinals) Evictions(_ context.Context, s *state.State, vpods []scheduler.VPod) ([]Eviction, error) {
+	var totalOccupied int32
+	for _, vpod := range s.VPods {
+		for _, placement := range vpod.GetPlacements() {
+			totalOccupied += placement.VReplicas
+		}
+	}
+
+	minPods := int32(math.Ceil(float64(totalOccupied) / float64(s.Capacity)))
+	if minPods < 1 {
+		minPods = 1
+	}
+
+	var evictions []Eviction
+	for _, vpod := range vpods {
+		for _, placement := range vpod.GetPlacements() {
+			placement := placement
+
+			ordinal, err := ordinalFromPodName(placement.PodName)
+			if err != nil || ordinal < minPods {
+				continue
+			}
+
+			reason := EvictionReasonCompaction
+			if placement.VReplicas > s.Capacity {
+				reason = EvictionReasonOverCapacity
+			}
+			evictions = append(evictions, Eviction{VPod: vpod, From: &placement, Reason: reason})
+		}
+	}
+
+	return evictions, nil
+}
+
+// removeDuplicatePlacements evicts redundant placements when a vpod ends up
+// with more than one placement on the same pod, e.g. after a scheduler race.
+//
+// This is eviction-based rebalancing, not an in-place merge: it evicts the
+// duplicate placement via the Evictor and relies on the next scheduling pass
+// to re-place those vreplicas, possibly combining them with the surviving
+// placement on the same pod. There is no guarantee they land back there in
+// the same cycle.
+type removeDuplicatePlacements struct{}
+
+func (p *removeDuplicatePlacements) Name() string { return RemoveDuplicatePlacementsName }
+
+func (p *removeDuplicatePlacements) Filter(s *state.State) []scheduler.VPod {
+	var out []scheduler.VPod
+	for _, vpod := range s.VPods {
+		seen := make(map[string]bool, len(vpod.GetPlacements()))
+		for _, placement := range vpod.GetPlacements() {
+			if seen[placement.PodName] {
+				out = append(out, vpod)
+				break
+			}
+			seen[placement.PodName] = true
+		}
+	}
+	return out
+}
+
+func (p *removeDuplicatePlacements) Evictions(_ context.Context, _ *state.State, vpods []scheduler.VPod) ([]Eviction, error) {
+	var evictions []Eviction
+	for _, vpod := range vpods {
+		seen := make(map[string]bool, len(vpod.GetPlacements()))
+		for _, placement := range vpod.GetPlacements() {
+			placement := placement
+			if seen[placement.PodName] {
+				evictions = append(evictions, Eviction{VPod: vpod, From: &placement, Reason: EvictionReasonCompaction})
+				continue
+			}
+			seen[placement.PodName] = true
+		}
+	}
+	return evictions, nil
+}
+
+// evictFromUnschedulablePods drains placements that sit on a pod that has
+// been marked unschedulable, e.g. because its node was cordoned.
+type evictFromUnschedulablePods struct{}
+
+func (p *evictFromUnschedulablePods) Name() string { return EvictFromUnschedulablePodsName }
+
+func (p *evictFromUnschedulablePods) Filter(s *state.State) []scheduler.VPod {
+	if s.PodLister == nil || s.NodeLister == nil {
+		return nil
+	}
+
+	var out []scheduler.VPod
+	for _, vpod := range s.VPods {
+		for _, placement := range vpod.GetPlacements() {
+			if isUnschedulablePod(s, placement.PodName) {
+				out = append(out, vpod)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (p *evictFromUnschedulablePods) Evictions(_ context.Context, s *state.State, vpods []scheduler.VPod) ([]Eviction, error) {
+	var evictions []Eviction
+	for _, vpod := range vpods {
+		for _, placement := range vpod.GetPlacements() {
+			placement := placement
+			if isUnschedulablePod(s, placement.PodName) {
+				evictions = append(evictions, Eviction{VPod: vpod, From: &placement, Reason: EvictionReasonUnschedulablePod})
+			}
+		}
+	}
+	return evictions, nil
+}
+
+// isUnschedulablePod reports whether podName carries
+// unschedulablePodAnnotation set to "true", or sits on a node that has been
+// cordoned. A pod that hasn't been assigned a node yet (e.g. right after a
+// scale-up) is not unschedulable, just pending, so it is deliberately not
+// flagged here: draining it would only make the pending placement worse.
+func isUnschedulablePod(s *state.State, podName string) bool {
+	pod, err := s.PodLister.Get(podName)
+	if err != nil {
+		return false
+	}
+	if pod.Annotations[unschedulablePodAnnotation] == "true" {
+		return true
+	}
+	if pod.Spec.NodeName == "" || s.NodeLister == nil {
+		return false
+	}
+	node, err := s.NodeLister.Get(pod.Spec.NodeName)
+	if err != nil {
+		return false
+	}
+	return node.Spec.Unschedulable
+}
+
+// ordinalFromPodName extracts the StatefulSet ordinal suffix from a pod
+// name of the form "<statefulset-name>-<ordinal>".
+func ordinalFromPodName(podName string) (int32, error) {
+	idx := strings.LastIndex(podName, "-")
+	if idx < 0 {
+		return 0, fmt.Errorf("invalid pod name %q", podName)
+	}
+	ordinal, err := strconv.ParseInt(podName[idx+1:], 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pod name %q: %w", podName, err)
+	}
+	return int32(ordinal), nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	duckv1alpha1 "knative.dev/eventing/pkg/apis/duck/v1alpha1"
+	"knative.dev/eventing/pkg/scheduler"
+	"knative.dev/eventing/pkg/scheduler/state"
+	tscheduler "knative.dev/eventing/pkg/scheduler/testing"
+)
+
+func newTestPodLister(pods ...*corev1.Pod) corelisters.PodNamespaceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, pod := range pods {
+		if err := indexer.Add(pod); err != nil {
+			panic(err)
+		}
+	}
+	return corelisters.NewPodLister(indexer).Pods(testNs)
+}
+
+func newTestNodeLister(nodes ...*corev1.Node) corelisters.NodeLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		if err := indexer.Add(node); err != nil {
+			panic(err)
+		}
+	}
+	return corelisters.NewNodeLister(indexer)
+}
+
+func TestRemoveDuplicatePlacements(t *testing.T) {
+	vpod := tscheduler.NewVPod(testNs, "vpod-1", 10, []duckv1alpha1.Placement{
+		{PodName: "statefulset-name-0", VReplicas: int32(4)},
+		{PodName: "statefulset-name-0", VReplicas: int32(6)},
+		{PodName: "statefulset-name-1", VReplicas: int32(3)},
+	})
+
+	p := &removeDuplicatePlacements{}
+	s := &state.State{VPods: []scheduler.VPod{vpod}}
+
+	filtered := p.Filter(s)
+	assert.Len(t, filtered, 1)
+
+	evictions, err := p.Evictions(context.Background(), s, filtered)
+	assert.NoError(t, err)
+	assert.Len(t, evictions, 1)
+	assert.Equal(t, "statefulset-name-0", evictions[0].From.PodName)
+	assert.Equal(t, int32(6), evictions[0].From.VReplicas)
+	assert.Equal(t, EvictionReasonCompaction, evictions[0].Reason)
+}
+
+func TestEvictFromUnschedulablePods(t *testing.T) {
+	cordonedNode := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "cordoned-node"},
+		Spec:       corev1.NodeSpec{Unschedulable: true},
+	}
+	healthyNode := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "healthy-node"},
+	}
+
+	testCases := []struct {
+		name        string
+		pod         *corev1.Pod
+		wantEvicted bool
+	}{
+		{
+			name:        "pod on a cordoned node is evicted",
+			pod:         tscheduler.MakePod(testNs, "statefulset-name-0", "cordoned-node"),
+			wantEvicted: true,
+		},
+		{
+			name:        "pod on a healthy node is left alone",
+			pod:         tscheduler.MakePod(testNs, "statefulset-name-0", "healthy-node"),
+			wantEvicted: false,
+		},
+		{
+			name:        "pod not yet assigned a node is pending, not unschedulable",
+			pod:         tscheduler.MakePod(testNs, "statefulset-name-0", ""),
+			wantEvicted: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			vpod := tscheduler.NewVPod(testNs, "vpod-1", 5, []duckv1alpha1.Placement{
+				{PodName: "statefulset-name-0", VReplicas: int32(5)},
+			})
+
+			s := &state.State{
+				VPods:      []scheduler.VPod{vpod},
+				PodLister:  newTestPodLister(tc.pod),
+				NodeLister: newTestNodeLister(cordonedNode, healthyNode),
+			}
+
+			p := &evictFromUnschedulablePods{}
+			filtered := p.Filter(s)
+			evictions, err := p.Evictions(context.Background(), s, filtered)
+			assert.NoError(t, err)
+
+			if !tc.wantEvicted {
+				assert.Empty(t, filtered)
+				assert.Empty(t, evictions)
+				return
+			}
+
+			assert.Len(t, evictions, 1)
+			assert.Equal(t, "statefulset-name-0", evictions[0].From.PodName)
+			assert.Equal(t, EvictionReasonUnschedulablePod, evictions[0].Reason)
+		})
+	}
+}
+
+func TestEvictFromUnschedulablePodsAnnotationOverride(t *testing.T) {
+	pod := tscheduler.MakePod(testNs, "statefulset-name-0", "healthy-node")
+	pod.Annotations = map[string]string{unschedulablePodAnnotation: "true"}
+
+	vpod := tscheduler.NewVPod(testNs, "vpod-1", 5, []duckv1alpha1.Placement{
+		{PodName: "statefulset-name-0", VReplicas: int32(5)},
+	})
+
+	s := &state.State{
+		VPods:      []scheduler.VPod{vpod},
+		PodLister:  newTestPodLister(pod),
+		NodeLister: newTestNodeLister(),
+	}
+
+	p := &evictFromUnschedulablePods{}
+	filtered := p.Filter(s)
+	evictions, err := p.Evictions(context.Background(), s, filtered)
+	assert.NoError(t, err)
+	assert.Len(t, evictions, 1)
+	assert.Equal(t, EvictionReasonUnschedulablePod, evictions[0].Reason)
+}
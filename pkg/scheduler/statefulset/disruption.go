@@ -0,0 +1,78 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"knative.dev/pkg/apis"
+
+	duckv1alpha1 "knative.dev/eventing/pkg/apis/duck/v1alpha1"
+	"knative.dev/eventing/pkg/scheduler"
+)
+
+// DisruptionRecorder is how an eviction gets surfaced as a
+// duckv1alpha1.PlacementCondition on the vpod's own status, the same way
+// EventTypeNormal Events are surfaced via Config.Recorder.
+//
+// Only a vpod that implements this interface receives the condition; for any
+// other vpod, evict below logs an error and records nothing. The interface
+// is not part of scheduler.VPod, and PlacementCondition is not a field of
+// any vpod duck status type, so where a received condition is stored is up
+// to the implementing vpod.
+type DisruptionRecorder interface {
+	RecordPlacementCondition(cond duckv1alpha1.PlacementCondition)
+}
+
+// evict calls the configured Evictor and then surfaces the eviction on the
+// vpod: a PlacementCondition (vpod must implement DisruptionRecorder; if it
+// doesn't, that is logged as an error since the condition is required, not
+// optional) and a Kubernetes Event (if both Config.Recorder and the vpod
+// support it).
+func (a *autoscaler) evict(logger logr.Logger, pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement, reason EvictionReason) error {
+	if err := a.cfg.Evictor(pod, vpod, from, reason); err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("placement of %d vreplicas on pod %s was evicted: %s", from.VReplicas, from.PodName, reason)
+
+	dr, ok := vpod.(DisruptionRecorder)
+	if !ok {
+		logger.Error(nil, "vpod does not implement DisruptionRecorder, dropping disruption condition", "vpod", vpod.GetKey())
+	} else {
+		dr.RecordPlacementCondition(duckv1alpha1.PlacementCondition{
+			Type:               duckv1alpha1.PlacementConditionDisrupted,
+			Status:             corev1.ConditionTrue,
+			Reason:             string(reason),
+			Message:            message,
+			LastTransitionTime: apis.VolatileTime{Inner: metav1.NewTime(a.clock.Now())},
+		})
+	}
+
+	if a.cfg.Recorder != nil {
+		if ro, ok := vpod.(runtime.Object); ok {
+			a.cfg.Recorder.Eventf(ro, corev1.EventTypeNormal, string(reason), message)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/testr"
+	kubeclient "knative.dev/pkg/client/injection/kube/client/fake"
+	_ "knative.dev/pkg/client/injection/kube/informers/apps/v1/statefulset/fake"
+	"knative.dev/pkg/reconciler"
+
+	duckv1alpha1 "knative.dev/eventing/pkg/apis/duck/v1alpha1"
+	listers "knative.dev/eventing/pkg/reconciler/testing/v1"
+	"knative.dev/eventing/pkg/scheduler"
+	"knative.dev/eventing/pkg/scheduler/state"
+	tscheduler "knative.dev/eventing/pkg/scheduler/testing"
+)
+
+// recordingVPod wraps a scheduler.VPod and additionally implements
+// DisruptionRecorder, so tests can assert that mayCompact records a
+// PlacementCondition on eviction.
+type recordingVPod struct {
+	scheduler.VPod
+
+	mu         sync.Mutex
+	conditions []duckv1alpha1.PlacementCondition
+}
+
+func (r *recordingVPod) RecordPlacementCondition(cond duckv1alpha1.PlacementCondition) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conditions = append(r.conditions, cond)
+}
+
+func (r *recordingVPod) Conditions() []duckv1alpha1.PlacementCondition {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]duckv1alpha1.PlacementCondition(nil), r.conditions...)
+}
+
+func TestCompactorRecordsDisruptionCondition(t *testing.T) {
+	ctx, _ := tscheduler.SetupFakeContext(t)
+
+	vpodClient := tscheduler.NewVPodClient()
+	vpod := &recordingVPod{
+		VPod: tscheduler.NewVPod(testNs, "vpod-1", 10, []duckv1alpha1.Placement{
+			{PodName: sfsName + "-0", VReplicas: int32(8)},
+			{PodName: sfsName + "-1", VReplicas: int32(2)},
+		}),
+	}
+	vpodClient.Append(vpod)
+
+	podlist := make([]runtime.Object, 0, 2)
+	for i := int32(0); i < 2; i++ {
+		podName := sfsName + "-0"
+		if i == 1 {
+			podName = sfsName + "-1"
+		}
+		pod, err := kubeclient.Get(ctx).CoreV1().Pods(testNs).Create(ctx, tscheduler.MakePod(testNs, podName, "node"), metav1.CreateOptions{})
+		if err != nil {
+			t.Fatal("unexpected error", err)
+		}
+		podlist = append(podlist, pod)
+	}
+
+	if _, err := kubeclient.Get(ctx).AppsV1().StatefulSets(testNs).Create(ctx, tscheduler.MakeStatefulset(testNs, sfsName, 2), metav1.CreateOptions{}); err != nil {
+		t.Fatal("unexpected error", err)
+	}
+
+	lsp := listers.NewListers(podlist)
+	scaleCache := scheduler.NewScaleCache(ctx, testNs, kubeclient.Get(ctx).AppsV1().StatefulSets(testNs), scheduler.ScaleCacheConfig{RefreshPeriod: time.Minute * 5})
+	stateAccessor := state.NewStateBuilder(sfsName, vpodClient.List, 10, lsp.GetPodLister().Pods(testNs), scaleCache)
+
+	recordEviction := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement, reason EvictionReason) error {
+		return nil
+	}
+
+	cfg := &Config{
+		StatefulSetNamespace: testNs,
+		StatefulSetName:      sfsName,
+		VPodLister:           vpodClient.List,
+		Evictor:              recordEviction,
+		RefreshPeriod:        10 * time.Second,
+		PodCapacity:          10,
+	}
+	autoscaler := newAutoscaler(ctx, cfg, stateAccessor, scaleCache)
+	_ = autoscaler.Promote(reconciler.UniversalBucket(), nil)
+
+	s, err := stateAccessor.State(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := autoscaler.mayCompact(logr.NewContext(ctx, testr.New(t)), s); err != nil {
+		t.Fatal(err)
+	}
+
+	conditions := vpod.Conditions()
+	if len(conditions) != 1 {
+		t.Fatalf("expected exactly 1 disruption condition, got %d: %v", len(conditions), conditions)
+	}
+
+	got := conditions[0]
+	if got.Type != duckv1alpha1.PlacementConditionDisrupted {
+		t.Errorf("unexpected condition type: %v", got.Type)
+	}
+	if got.Status != corev1.ConditionTrue {
+		t.Errorf("unexpected condition status: %v", got.Status)
+	}
+	if got.Reason != string(EvictionReasonCompaction) {
+		t.Errorf("unexpected condition reason: %v", got.Reason)
+	}
+	if got.Message == "" {
+		t.Errorf("expected a non-empty condition message")
+	}
+	if got.LastTransitionTime.Inner.IsZero() {
+		t.Errorf("expected LastTransitionTime to be set")
+	}
+}
+
+// errorCapturingSink is a minimal logr.LogSink that only records the
+// messages passed to Error, so tests can assert on them without pulling in
+// a structured logging test helper.
+type errorCapturingSink struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (s *errorCapturingSink) Init(logr.RuntimeInfo)            {}
+func (s *errorCapturingSink) Enabled(int) bool                 { return true }
+func (s *errorCapturingSink) Info(int, string, ...interface{}) {}
+func (s *errorCapturingSink) WithValues(...interface{}) logr.LogSink {
+	return s
+}
+func (s *errorCapturingSink) WithName(string) logr.LogSink { return s }
+
+func (s *errorCapturingSink) Error(_ error, msg string, _ ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, msg)
+}
+
+func (s *errorCapturingSink) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+// TestEvictLogsMissingDisruptionRecorder asserts that evicting a vpod which
+// doesn't implement DisruptionRecorder is a loud, logged error rather than
+// a silently dropped disruption condition.
+func TestEvictLogsMissingDisruptionRecorder(t *testing.T) {
+	vpod := tscheduler.NewVPod(testNs, "vpod-1", 5, []duckv1alpha1.Placement{
+		{PodName: sfsName + "-0", VReplicas: int32(5)},
+	})
+	placement := vpod.GetPlacements()[0]
+
+	recordEviction := func(pod *corev1.Pod, vpod scheduler.VPod, from *duckv1alpha1.Placement, reason EvictionReason) error {
+		return nil
+	}
+
+	a := &autoscaler{cfg: &Config{Evictor: recordEviction}}
+
+	sink := &errorCapturingSink{}
+	pod := tscheduler.MakePod(testNs, sfsName+"-0", "node")
+	if err := a.evict(logr.New(sink), pod, vpod, &placement, EvictionReasonCompaction); err != nil {
+		t.Fatal(err)
+	}
+
+	if messages := sink.Messages(); len(messages) != 1 {
+		t.Fatalf("expected exactly 1 logged error about the missing DisruptionRecorder, got %d: %v", len(messages), messages)
+	}
+}
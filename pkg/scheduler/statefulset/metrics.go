@@ -0,0 +1,33 @@
+/*
+Copyright 2020 The Knative Authors
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statefulset
+
+import "github.com/prometheus/client_golang/prometheus"
+
+// pendingScaleDownGauge reports the unix timestamp at which a pending
+// scale-down decision will be applied, per StatefulSet. It reads 0 when no
+// scale-down is currently pending.
+var pendingScaleDownGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "eventing",
+	Subsystem: "statefulset_scheduler",
+	Name:      "pending_scale_down_time_seconds",
+	Help:      "Unix time at which a pending scale-down of the StatefulSet will be applied, or 0 if none is pending.",
+}, []string{"namespace", "name"})
+
+func init() {
+	prometheus.MustRegister(pendingScaleDownGauge)
+}